@@ -0,0 +1,59 @@
+package ghost
+
+// Backend abstracts the medium a Store persists its segments and index
+// files to. Everything above this layer (Store, the binary index format in
+// idxfile.go, Compact, Batch) only ever works with logical segment names
+// and byte offsets; it's Backend's job to decide what a name maps to - a
+// file on disk, a key in an in-memory map, a value in a BoltDB bucket - and
+// to own the lifetime of whatever handle that takes. That's what lets a
+// Store run inside a process that can't open raw filesystem paths (under
+// WASM, say, or on top of an object store), and it's also what moves the
+// file-descriptor bookkeeping that used to live in Store.files into
+// backend-local concerns: each backend decides for itself how (and
+// whether) to cache open segments.
+//
+// Shipped implementations: filesystem (backend_fs.go), in-memory
+// (backend_memory.go), and BoltDB (backend_bolt.go). A Redis-backed
+// implementation was considered but dropped - Redis has no equivalent of a
+// stable random-access byte range to hand back from Bytes, so every read
+// would pay a network round trip and a full-value copy, which defeats the
+// point of this interface.
+type Backend interface {
+	// Open returns the Segment for name, creating an empty one if it
+	// doesn't already exist. Backends are expected to cache and reuse the
+	// Segment they return across calls with the same name.
+	Open(name string) (Segment, error)
+
+	// Remove deletes the named segment. Removing a segment that doesn't
+	// exist is not an error.
+	Remove(name string) error
+
+	// List returns the names of every segment currently stored whose name
+	// starts with prefix.
+	List(prefix string) ([]string, error)
+
+	// Close releases every resource the backend is holding open.
+	Close() error
+}
+
+// Segment is a single random-access byte area backing one store[i] or
+// index[i] slot. Store and the binary index format (idxfile.go) only ever
+// need random-access reads and writes plus truncation, which every backend
+// here - a file, an in-memory buffer, a BoltDB value - can provide without
+// needing its own notion of "append".
+type Segment interface {
+	ReadAt(p []byte, off int64) (int, error)
+	WriteAt(p []byte, off int64) (int, error)
+	Size() (int64, error)
+	Truncate(size int64) error
+
+	// Bytes returns a zero-copy view of the segment's entire current
+	// contents, when the backend can provide one (an mmap, or a buffer
+	// that's already resident in memory). The second return value is
+	// false when the backend has to materialize a copy to answer a read
+	// (BoltDB, which has no notion of a stable pointer into its pages) -
+	// callers fall back to ReadAt in that case.
+	Bytes() ([]byte, bool)
+
+	Close() error
+}
@@ -0,0 +1,141 @@
+package ghost
+
+import (
+	"bytes"
+	"io"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltSegmentsBucket = []byte("segments")
+
+// boltSegment stores its entire contents as a single value under its name
+// in the segments bucket. BoltDB has no notion of a random-access byte
+// range within a value, so ReadAt/WriteAt/Truncate all read or rewrite the
+// whole value - a read-modify-write trade-off that's fine at the sizes a
+// single store/index segment reaches between compactions.
+type boltSegment struct {
+	db  *bolt.DB
+	key []byte
+}
+
+func (s *boltSegment) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltSegmentsBucket).Get(s.key)
+		if off >= int64(len(data)) {
+			return io.EOF
+		}
+		n = copy(p, data[off:])
+		if n < len(p) {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (s *boltSegment) WriteAt(p []byte, off int64) (int, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltSegmentsBucket)
+		data := append([]byte(nil), b.Get(s.key)...)
+
+		end := off + int64(len(p))
+		if end > int64(len(data)) {
+			grown := make([]byte, end)
+			copy(grown, data)
+			data = grown
+		}
+		copy(data[off:], p)
+		return b.Put(s.key, data)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *boltSegment) Size() (int64, error) {
+	var n int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		n = int64(len(tx.Bucket(boltSegmentsBucket).Get(s.key)))
+		return nil
+	})
+	return n, err
+}
+
+func (s *boltSegment) Truncate(size int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltSegmentsBucket)
+		data := b.Get(s.key)
+		if size <= int64(len(data)) {
+			return b.Put(s.key, append([]byte(nil), data[:size]...))
+		}
+		return nil
+	})
+}
+
+// Bytes always reports no zero-copy view: a BoltDB value is only valid for
+// the lifetime of the transaction it was read in, so there's no pointer a
+// caller could safely hold onto across calls the way an mmap allows.
+func (s *boltSegment) Bytes() ([]byte, bool) {
+	return nil, false
+}
+
+func (s *boltSegment) Close() error {
+	return nil
+}
+
+// boltBackend stores every store and index segment as a key/value pair in
+// a single BoltDB bucket, one DB file for the whole store - one bucket is
+// enough since ghost's segments are already named uniquely.
+type boltBackend struct {
+	db *bolt.DB
+}
+
+// NewBoltBackend opens (creating if necessary) a BoltDB database at path
+// and returns a Backend backed by it.
+func NewBoltBackend(path string) (Backend, error) {
+	db, err := bolt.Open(path, 0664, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltSegmentsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltBackend{db: db}, nil
+}
+
+func (b *boltBackend) Open(name string) (Segment, error) {
+	return &boltSegment{db: b.db, key: []byte(name)}, nil
+}
+
+func (b *boltBackend) Remove(name string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSegmentsBucket).Delete([]byte(name))
+	})
+}
+
+func (b *boltBackend) List(prefix string) ([]string, error) {
+	var out []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltSegmentsBucket).Cursor()
+		p := []byte(prefix)
+		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+			out = append(out, string(k))
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (b *boltBackend) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,117 @@
+package ghost
+
+import (
+	"io"
+	"strings"
+	"sync"
+)
+
+// memSegment is an in-memory Segment: just a growable byte slice guarded by
+// a mutex. Since the data never leaves the process, Bytes() can always hand
+// back a zero-copy view.
+type memSegment struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (s *memSegment) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if off >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[off:])
+	if n < len(p) {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
+
+func (s *memSegment) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	end := off + int64(len(p))
+	if end > int64(len(s.data)) {
+		grown := make([]byte, end)
+		copy(grown, s.data)
+		s.data = grown
+	}
+	copy(s.data[off:], p)
+	return len(p), nil
+}
+
+func (s *memSegment) Size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(len(s.data)), nil
+}
+
+func (s *memSegment) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if size <= int64(len(s.data)) {
+		s.data = s.data[:size]
+	}
+	return nil
+}
+
+func (s *memSegment) Bytes() ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data, true
+}
+
+func (s *memSegment) Close() error {
+	return nil
+}
+
+// memoryBackend keeps every segment as an in-memory buffer, replacing the
+// ad-hoc temp-directory setup tests used to need.
+type memoryBackend struct {
+	mu   sync.Mutex
+	segs map[string]*memSegment
+}
+
+// NewMemoryBackend returns a Backend that never touches disk.
+func NewMemoryBackend() Backend {
+	return &memoryBackend{segs: make(map[string]*memSegment)}
+}
+
+func (b *memoryBackend) Open(name string) (Segment, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.segs[name]
+	if !ok {
+		s = &memSegment{}
+		b.segs[name] = s
+	}
+	return s, nil
+}
+
+func (b *memoryBackend) Remove(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.segs, name)
+	return nil
+}
+
+func (b *memoryBackend) List(prefix string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var out []string
+	for name := range b.segs {
+		if strings.HasPrefix(name, prefix) {
+			out = append(out, name)
+		}
+	}
+	return out, nil
+}
+
+func (b *memoryBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,95 @@
+package ghost
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestStoreFilesystemBackendRoundTrip exercises a real Store against the
+// default filesystem Backend - the mmap read path in mmap.go/backend_fs.go
+// - rather than the in-memory or BoltDB backends the other tests in this
+// package use. The Put of "b" after "a" has already been read back has to go
+// through an actual mmap remap for Get to see its just-written bytes.
+func TestStoreFilesystemBackendRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open(dir, GobSchema{})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	if err := s.Put("a", "a-v1"); err != nil {
+		t.Fatalf("Put(a): %v", err)
+	}
+
+	var got string
+	if err := s.Get("a", &got); err != nil || got != "a-v1" {
+		t.Fatalf("Get(a) = %q, %v, want a-v1, nil", got, err)
+	}
+
+	if err := s.Put("b", "b-v1"); err != nil {
+		t.Fatalf("Put(b): %v", err)
+	}
+	if err := s.Get("b", &got); err != nil || got != "b-v1" {
+		t.Fatalf("Get(b) = %q, %v, want b-v1, nil", got, err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Reopen against the same directory to confirm the on-disk layout
+	// (conf + binary index + store segment) actually persists.
+	s2, err := Open(dir, GobSchema{})
+	if err != nil {
+		t.Fatalf("re-Open: %v", err)
+	}
+	defer s2.Close()
+
+	got = ""
+	if err := s2.Get("a", &got); err != nil || got != "a-v1" {
+		t.Fatalf("Get(a) after reopen = %q, %v, want a-v1, nil", got, err)
+	}
+}
+
+// TestStoreBoltBackendRoundTrip exercises a real Store against the BoltDB
+// Backend, which has neither an mmap nor a zero-copy Bytes view - Get falls
+// back to ReadAt, exactly the path the in-memory backend's always-zero-copy
+// Bytes never touches.
+func TestStoreBoltBackendRoundTrip(t *testing.T) {
+	backend, err := NewBoltBackend(filepath.Join(t.TempDir(), "store.bolt"))
+	if err != nil {
+		t.Fatalf("NewBoltBackend: %v", err)
+	}
+	defer backend.Close()
+
+	s := NewStore("", GobSchema{}, WithBackend(backend))
+	s.capacity = 1 // also exercise a rollover across this backend.
+
+	if err := s.Put("a", "a-v1"); err != nil {
+		t.Fatalf("Put(a): %v", err)
+	}
+	if err := s.Put("a", "a-v2"); err != nil {
+		t.Fatalf("Put(a, a-v2): %v", err)
+	}
+	if err := s.Put("b", "b-v1"); err != nil {
+		t.Fatalf("Put(b): %v", err)
+	}
+
+	var got string
+	if err := s.Get("a", &got); err != nil || got != "a-v2" {
+		t.Fatalf("Get(a) = %q, %v, want a-v2, nil", got, err)
+	}
+	if err := s.Get("b", &got); err != nil || got != "b-v1" {
+		t.Fatalf("Get(b) = %q, %v, want b-v1, nil", got, err)
+	}
+
+	if err := s.Delete("b"); err != nil {
+		t.Fatalf("Delete(b): %v", err)
+	}
+
+	got = "untouched"
+	if err := s.Get("b", &got); err != nil || got != "untouched" {
+		t.Fatalf("Get(b) after delete = %q, %v, want untouched, nil", got, err)
+	}
+}
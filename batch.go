@@ -0,0 +1,175 @@
+package ghost
+
+import (
+	"hash/crc32"
+
+	"github.com/go-errors/errors"
+)
+
+type batchOp struct {
+	id     string
+	del    bool
+	object interface{}
+}
+
+// Batch collects a sequence of Set/Delete operations to be applied
+// atomically by Store.ExecuteBatch, which issues a single append to the
+// store segment and a single Flush - rather than the N of each that a loop
+// of Put/Delete would cost. Index records are still appended one per
+// operation.
+type Batch struct {
+	ops []batchOp
+}
+
+// NewBatch creates an empty Batch.
+func (s *Store) NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Set stages a Put of o under id.
+func (b *Batch) Set(id string, o interface{}) {
+	b.ops = append(b.ops, batchOp{id: id, object: o})
+}
+
+// Delete stages a tombstone for id.
+func (b *Batch) Delete(id string) {
+	b.ops = append(b.ops, batchOp{id: id, del: true})
+}
+
+// Reset discards every staged operation so the Batch can be reused.
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Size returns the number of staged operations.
+func (b *Batch) Size() int {
+	return len(b.ops)
+}
+
+// ExecuteBatch applies every Set/Delete staged in b. Every Set's encoded
+// bytes are written to the current store segment in a single WriteAt, each
+// staged operation appends one record to its index file (the current
+// segment's for a Set, every segment still holding a live entry for a
+// Delete), each affected file's cached reader is dropped once, and Flush is
+// called once at the end. If the write fails partway through, the store
+// segment is truncated back to its pre-write size so a failed batch leaves
+// no trace.
+func (s *Store) ExecuteBatch(b *Batch) error {
+	type encoded struct {
+		id    string
+		bytes []byte
+		del   bool
+	}
+
+	encs := make([]encoded, 0, len(b.ops))
+	for _, op := range b.ops {
+		if op.del {
+			encs = append(encs, encoded{id: op.id, del: true})
+			continue
+		}
+		bs, err := s.schema.Marshal(op.object)
+		if err != nil {
+			return err
+		}
+		encs = append(encs, encoded{id: op.id, bytes: bs})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	preSize, preInserts := s.size, s.inserts
+	preIndexLen, preStoreLen := len(s.index), len(s.store)
+
+	// Reset the inserts if above the maximum, same as Put - a batch that
+	// crosses the capacity boundary still only ever appends to the segment
+	// that was current when the batch started. If the write below fails,
+	// this rollover is unwound along with size/inserts so a new, empty
+	// segment isn't left registered in s.index/s.store.
+	if s.inserts >= s.capacity {
+		s.inserts = 0
+		s.size = 0
+		s.index = append(s.index, s.indexName())
+		s.store = append(s.store, s.indexName())
+	}
+
+	idx := len(s.index) - 1
+	storeName := s.store[idx]
+	writeOffset := s.size
+
+	seg, err := s.backend.Open(storeName)
+	if err != nil {
+		return err
+	}
+
+	type idxOp struct {
+		id identifier
+		m  meta
+	}
+	byFile := make(map[string][]idxOp)
+	currentFile := s.index[idx]
+
+	var payload []byte
+	offset := s.size
+	sets := 0
+	for _, e := range encs {
+		if e.del {
+			for k, name := range s.index {
+				r, err := s.idxReaderFor(name)
+				if err != nil {
+					return err
+				}
+				cur, err := r.Find(identifier(e.id))
+				if err != nil {
+					return err
+				}
+				if cur != nil && !cur.Deleted {
+					byFile[name] = append(byFile[name], idxOp{id: identifier(e.id), m: meta{Index: k, Deleted: true}})
+				}
+			}
+			continue
+		}
+
+		m := meta{Index: idx, Offset: offset, Len: len(e.bytes), Crc32: crc32.ChecksumIEEE(e.bytes)}
+		byFile[currentFile] = append(byFile[currentFile], idxOp{id: identifier(e.id), m: m})
+		payload = append(payload, e.bytes...)
+		offset += len(e.bytes)
+		sets++
+	}
+
+	if len(payload) > 0 {
+		if _, err := seg.WriteAt(payload, int64(writeOffset)); err != nil {
+			s.size, s.inserts = preSize, preInserts
+			s.index, s.store = s.index[:preIndexLen], s.store[:preStoreLen]
+			if tErr := seg.Truncate(int64(writeOffset)); tErr != nil {
+				return errors.Errorf("ghost: batch write failed (%v), and rollback truncate of %q also failed (%v): store may have trailing garbage past offset %d", err, storeName, tErr, writeOffset)
+			}
+			return err
+		}
+	}
+
+	for file, ops := range byFile {
+		w, err := s.idxWriterFor(file)
+		if err != nil {
+			return err
+		}
+		for _, op := range ops {
+			if err := w.Add(op.id, op.m); err != nil {
+				return err
+			}
+			if op.m.Deleted {
+				delete(s.identifiers, op.id)
+			} else {
+				s.identifiers[op.id] = true
+				if s.indexCache != nil {
+					s.indexCache.Put(op.id, op.m)
+				}
+			}
+		}
+		s.evictIdxReader(file)
+	}
+
+	s.size = offset
+	s.inserts += sets
+
+	return s.Flush()
+}
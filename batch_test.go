@@ -0,0 +1,92 @@
+package ghost
+
+import (
+	"errors"
+	"testing"
+)
+
+// failOnceSegment wraps a Segment and fails its next WriteAt once armed,
+// then behaves normally again - just enough to simulate ExecuteBatch's
+// append failing partway through.
+type failOnceSegment struct {
+	Segment
+	fail *bool
+}
+
+func (s *failOnceSegment) WriteAt(p []byte, off int64) (int, error) {
+	if *s.fail {
+		*s.fail = false
+		return 0, errors.New("injected write failure")
+	}
+	return s.Segment.WriteAt(p, off)
+}
+
+// armNextOpenBackend fails the next WriteAt issued against whichever
+// segment the next Open call returns, without needing to know that
+// segment's name up front (segment names are random).
+type armNextOpenBackend struct {
+	Backend
+	armed bool
+	fail  bool
+}
+
+func (b *armNextOpenBackend) Open(name string) (Segment, error) {
+	seg, err := b.Backend.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if b.armed {
+		b.armed = false
+		b.fail = true
+		return &failOnceSegment{Segment: seg, fail: &b.fail}, nil
+	}
+	return seg, nil
+}
+
+// TestExecuteBatchRollsBackSegmentRolloverOnWriteFailure covers the case
+// where a batch crosses the capacity boundary (registering a fresh, empty
+// segment in s.index/s.store) and the subsequent WriteAt to that new
+// segment then fails: the new segment's registration must be unwound along
+// with size/inserts, or the next Put corrupts it by writing at the old
+// segment's offset into the new one.
+func TestExecuteBatchRollsBackSegmentRolloverOnWriteFailure(t *testing.T) {
+	backend := &armNextOpenBackend{Backend: NewMemoryBackend()}
+	s := NewStore("", GobSchema{}, WithBackend(backend))
+	s.capacity = 1 // the next Put/batch always crosses the boundary.
+
+	if err := s.Put("a", "a-v1"); err != nil {
+		t.Fatalf("Put(a): %v", err)
+	}
+
+	preIndex := append([]string(nil), s.index...)
+	preStore := append([]string(nil), s.store...)
+
+	// The batch below rolls over to a new segment; arm the next Open (that
+	// new segment's) to fail its write.
+	backend.armed = true
+
+	b := s.NewBatch()
+	b.Set("b", "b-v1")
+	if err := s.ExecuteBatch(b); err == nil {
+		t.Fatal("ExecuteBatch should have failed")
+	}
+
+	if len(s.index) != len(preIndex) || len(s.store) != len(preStore) {
+		t.Fatalf("s.index/s.store left at len %d/%d after rollback, want %d/%d (pre-rollover)",
+			len(s.index), len(s.store), len(preIndex), len(preStore))
+	}
+
+	// A subsequent Put must still succeed (with capacity 1 it rolls over to
+	// a fresh segment of its own), and both "a" and "c" must read back.
+	if err := s.Put("c", "c-v1"); err != nil {
+		t.Fatalf("Put(c) after rolled-back batch: %v", err)
+	}
+
+	var got string
+	if err := s.Get("a", &got); err != nil || got != "a-v1" {
+		t.Fatalf("Get(a) = %q, %v, want a-v1, nil", got, err)
+	}
+	if err := s.Get("c", &got); err != nil || got != "c-v1" {
+		t.Fatalf("Get(c) = %q, %v, want c-v1, nil", got, err)
+	}
+}
@@ -1,40 +1,138 @@
 package ghost
 
 import (
-	"math/rand"
+	"container/list"
 	"sync"
+	"unsafe"
 )
 
+// cacheEntry is the value stored in IndexCache's list; id is kept alongside
+// m so an evicted element can remove itself from items without needing a
+// reverse index.
+type cacheEntry struct {
+	id identifier
+	m  meta
+}
+
+// entrySize estimates the bytes an entry holds down in the cache: its
+// identifier plus a fixed-size meta. It's an estimate, not an exact
+// accounting of the list.Element/map overhead, but it's good enough for
+// callers bounding the cache by a rough memory budget.
+func entrySize(id identifier, m meta) int {
+	return len(id) + int(unsafe.Sizeof(m))
+}
+
+// IndexCache is a fixed-capacity LRU cache of identifier -> meta, consulted
+// by Store.Get before falling back to a GetMeta index lookup. Eviction order
+// is by recency of use: Get promotes its hit to the front of ll, and Put
+// evicts from the back once a limit is exceeded.
 type IndexCache struct {
-	capacity int
+	capacity int // max entries; 0 means unbounded by count.
+	maxBytes int // max estimated bytes across all entries; 0 means unbounded by bytes.
+	bytes    int // current estimated bytes held.
+
+	ll    *list.List
+	items map[identifier]*list.Element
+
+	mu sync.RWMutex
+}
 
-	lookup   map[identifier]int
-	metadata []meta
+// IndexCacheOption configures an IndexCache built by NewIndexCache.
+type IndexCacheOption func(*IndexCache)
 
-	mu sync.Mutex
+// WithMaxBytes bounds the cache by an estimate of the bytes its entries
+// occupy rather than (or in addition to) their count, so a handful of large
+// stores don't evict each other purely because a global identifier limit
+// is already known to fit in memory. Pass capacity 0 to NewIndexCache to
+// bound purely by bytes.
+func WithMaxBytes(n int) IndexCacheOption {
+	return func(c *IndexCache) {
+		c.maxBytes = n
+	}
 }
 
-func NewIndexCache(capacity int) *IndexCache {
-	return &IndexCache{
+// NewIndexCache creates an IndexCache holding up to capacity entries. A
+// capacity of 0 leaves the cache unbounded by entry count, which is only
+// useful combined with WithMaxBytes.
+func NewIndexCache(capacity int, options ...IndexCacheOption) *IndexCache {
+	c := &IndexCache{
 		capacity: capacity,
-		lookup:   make(map[identifier]int),
-		metadata: make([]meta, capacity),
+		ll:       list.New(),
+		items:    make(map[identifier]*list.Element),
+	}
+	for _, option := range options {
+		option(c)
 	}
+	return c
 }
 
-func (i *IndexCache) Get(id identifier) *meta {
-	i.mu.Lock()
-	defer i.mu.Unlock()
-	if v, ok := i.lookup[id]; ok {
-		return &i.metadata[v]
+// Get returns the cached meta for id, if present, promoting it to
+// most-recently-used. The lookup and the already-at-front check only need a
+// read lock; MoveToFront is only worth a separate write-locked step when the
+// entry isn't already at the front, which skips the exclusive lock entirely
+// for repeated hits on the same hot id - the common case for a cache.
+func (c *IndexCache) Get(id identifier) (meta, bool) {
+	c.mu.RLock()
+	el, ok := c.items[id]
+	if !ok {
+		c.mu.RUnlock()
+		return meta{}, false
+	}
+	m := el.Value.(*cacheEntry).m
+	atFront := c.ll.Front() == el
+	c.mu.RUnlock()
+
+	if !atFront {
+		c.mu.Lock()
+		c.ll.MoveToFront(el)
+		c.mu.Unlock()
+	}
+
+	return m, true
+}
+
+// Put inserts or updates the cached meta for id as most-recently-used,
+// evicting least-recently-used entries until the cache is back within its
+// capacity and maxBytes limits.
+func (c *IndexCache) Put(id identifier, m meta) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[id]; ok {
+		e := el.Value.(*cacheEntry)
+		c.bytes += entrySize(id, m) - entrySize(id, e.m)
+		e.m = m
+		c.ll.MoveToFront(el)
+	} else {
+		e := &cacheEntry{id: id, m: m}
+		c.items[id] = c.ll.PushFront(e)
+		c.bytes += entrySize(id, m)
+	}
+
+	for (c.capacity > 0 && c.ll.Len() > c.capacity) || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.evictOldest()
+	}
+}
+
+// evictOldest drops the least-recently-used entry. Callers must hold mu.
+func (c *IndexCache) evictOldest() {
+	el := c.ll.Back()
+	if el == nil {
+		return
 	}
-	return nil
+	c.ll.Remove(el)
+	e := el.Value.(*cacheEntry)
+	delete(c.items, e.id)
+	c.bytes -= entrySize(e.id, e.m)
 }
 
-func (i *IndexCache) Put(id identifier, m meta) {
+// Clear discards every cached entry. Store.Compact calls this after
+// swapping in a new set of segments, since cached meta.Index values point
+// at segment positions that Compact has just invalidated.
+func (i *IndexCache) Clear() {
 	i.mu.Lock()
 	defer i.mu.Unlock()
-	idx := rand.Intn(i.capacity)
-	i.metadata[idx] = m
-	i.lookup[id] = idx
+	i.ll = list.New()
+	i.items = make(map[identifier]*list.Element)
+	i.bytes = 0
 }
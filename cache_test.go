@@ -0,0 +1,53 @@
+package ghost
+
+import "testing"
+
+// TestIndexCacheEvictsLeastRecentlyUsed checks eviction order and that
+// lookup never holds on to a stale identifier after its entry is evicted -
+// the bug the old random-eviction implementation had.
+func TestIndexCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewIndexCache(2)
+
+	c.Put("a", meta{Offset: 1})
+	c.Put("b", meta{Offset: 2})
+
+	// Touch "a" so "b" becomes the least-recently-used entry.
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("Get(a) miss, want hit")
+	}
+
+	c.Put("c", meta{Offset: 3})
+
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("Get(b) hit, want miss: b should have been evicted as LRU")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("Get(a) miss, want hit: a was touched more recently than b")
+	}
+	if _, ok := c.Get("c"); !ok {
+		t.Fatal("Get(c) miss, want hit")
+	}
+	if c.ll.Len() != 2 {
+		t.Fatalf("cache holds %d entries, want 2", c.ll.Len())
+	}
+	if len(c.items) != 2 {
+		t.Fatalf("lookup holds %d entries, want 2 (evicted entries must be removed from lookup too)", len(c.items))
+	}
+}
+
+// TestIndexCacheMaxBytes checks that a byte-size budget evicts even when
+// the entry-count capacity hasn't been reached.
+func TestIndexCacheMaxBytes(t *testing.T) {
+	c := NewIndexCache(0, WithMaxBytes(entrySize("a", meta{})+entrySize("b", meta{})))
+
+	c.Put("a", meta{})
+	c.Put("b", meta{})
+	c.Put("c", meta{})
+
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("Get(a) hit, want miss: a should have been evicted once the byte budget was exceeded")
+	}
+	if _, ok := c.Get("c"); !ok {
+		t.Fatal("Get(c) miss, want hit")
+	}
+}
@@ -0,0 +1,48 @@
+package ghost
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// chunkReader is the read side of a store segment: it goes through a
+// Backend to get a zero-copy view of a segment where one's available (an
+// mmap behind the filesystem backend, a buffer behind the in-memory one) so
+// Get can hand Schema.Unmarshal a pointer slice straight into it instead of
+// copying the segment into memory on every call. Backends that can't
+// provide that view (BoltDB) fall back to a plain ReadAt of just the bytes
+// asked for.
+type chunkReader struct {
+	backend Backend
+}
+
+func newChunkReader(backend Backend) *chunkReader {
+	return &chunkReader{backend: backend}
+}
+
+// Read returns the length bytes at offset within the named segment,
+// zero-copy when the backend allows it.
+func (c *chunkReader) Read(name string, offset, length int) ([]byte, error) {
+	seg, err := c.backend.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if b, ok := seg.Bytes(); ok {
+		if offset+length > len(b) {
+			return nil, errors.Errorf("ghost: chunk read [%d:%d] out of range for segment %q (%d bytes mapped)", offset, offset+length, name, len(b))
+		}
+		return b[offset : offset+length], nil
+	}
+
+	b := make([]byte, length)
+	if _, err := seg.ReadAt(b, int64(offset)); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Close releases every resource this reader is holding open by closing the
+// backend it reads through.
+func (c *chunkReader) Close() error {
+	return c.backend.Close()
+}
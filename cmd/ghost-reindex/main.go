@@ -0,0 +1,58 @@
+// Command ghost-reindex converts the legacy JSON index files of a ghost
+// store directory (from before the binary index format) into the new
+// format in place. It can be run safely against a live store directory
+// multiple times; files already in the binary format are left untouched.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+
+	"github.com/hscells/ghost"
+)
+
+// conf mirrors the unexported info struct Store.Flush writes to the "conf"
+// file; it's duplicated here rather than exported since only the index
+// names are needed.
+type conf struct {
+	Index []string `json:"indexes"`
+}
+
+func main() {
+	dir := flag.String("dir", "", "path to a ghost store directory")
+	flag.Parse()
+
+	if *dir == "" {
+		fmt.Fprintln(os.Stderr, "usage: ghost-reindex -dir <store directory>")
+		os.Exit(1)
+	}
+
+	f, err := os.Open(path.Join(*dir, "conf"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	var c conf
+	if err := json.NewDecoder(f).Decode(&c); err != nil {
+		log.Fatal(err)
+	}
+
+	var migrated int
+	for _, name := range c.Index {
+		ok, err := ghost.MigrateIndex(path.Join(*dir, name))
+		if err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		if ok {
+			migrated++
+			log.Printf("migrated %s", name)
+		}
+	}
+
+	log.Printf("done: migrated %d index file(s)", migrated)
+}
@@ -0,0 +1,244 @@
+package ghost
+
+// Delete marks the object with the specified id as removed by appending a
+// tombstone (a meta with Deleted set) to every index file that still holds a
+// live entry for it - an id re-Put after a capacity rollover can have one in
+// more than one segment. The object's bytes are left in place in the store
+// segment; Compact is what actually reclaims them.
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		m, err := s.GetMeta(identifier(id))
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			break
+		}
+
+		idxName := s.index[m.Index]
+		w, err := s.idxWriterFor(idxName)
+		if err != nil {
+			return err
+		}
+
+		tomb := meta{Index: m.Index, Deleted: true}
+		if err := w.Add(identifier(id), tomb); err != nil {
+			return err
+		}
+
+		s.evictIdxReader(idxName)
+
+		if s.indexCache != nil {
+			s.indexCache.Put(identifier(id), tomb)
+		}
+	}
+
+	delete(s.identifiers, identifier(id))
+
+	return nil
+}
+
+// CompactReport summarizes the effect of a call to Compact.
+type CompactReport struct {
+	SegmentsBefore int // sealed (index, store) pairs considered.
+	SegmentsAfter  int // (index, store) pairs they were collapsed into.
+	RecordsKept    int
+	RecordsDropped int // ids whose latest record is a tombstone, plus copies superseded by a later segment in the same merge.
+	BytesReclaimed int
+}
+
+// segmentLiveEntries reads a sealed segment's index and returns its live
+// (non-tombstoned) entries, keeping only the most recent record per id.
+func segmentLiveEntries(backend Backend, idxName string) ([]idxEntry, int, error) {
+	r, err := openIdxReader(backend, idxName)
+	if err != nil {
+		return nil, 0, err
+	}
+	all, err := r.entries()
+	r.Close()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	latest := make(map[identifier]idxEntry, len(all))
+	for _, e := range all {
+		latest[e.id] = e
+	}
+
+	var dropped int
+	live := make([]idxEntry, 0, len(latest))
+	for _, e := range latest {
+		if e.deleted {
+			dropped++
+			continue
+		}
+		live = append(live, e)
+	}
+	return live, dropped, nil
+}
+
+// Compact rewrites every sealed (index, store) segment pair - every pair
+// except the one currently being appended to by Put - into fresh pairs that
+// hold only live records, reclaiming the bytes tombstoned by Delete and any
+// but the most recent record for ids that were overwritten by a later Put.
+// Consecutive sealed segments whose combined live record count stays under
+// capacity are merged into a single pair, bounding the number of index
+// files GetMeta has to fan out across.
+//
+// Readers are only blocked briefly, at the very end, while the new segment
+// list is swapped in; the rewriting itself happens against the old segments
+// without holding the store lock.
+func (s *Store) Compact() (CompactReport, error) {
+	var report CompactReport
+
+	s.mu.Lock()
+	sealed := len(s.index) - 1
+	oldIndex := append([]string(nil), s.index[:sealed]...)
+	oldStore := append([]string(nil), s.store[:sealed]...)
+	capacity := s.capacity
+	backend := s.backend
+	s.mu.Unlock()
+
+	report.SegmentsBefore = sealed
+	if sealed == 0 {
+		return report, nil
+	}
+
+	type segment struct {
+		indexName, storeName string
+		live                 []idxEntry
+	}
+
+	segments := make([]segment, sealed)
+	for i := 0; i < sealed; i++ {
+		live, dropped, err := segmentLiveEntries(backend, oldIndex[i])
+		if err != nil {
+			return report, err
+		}
+		report.RecordsDropped += dropped
+		segments[i] = segment{indexName: oldIndex[i], storeName: oldStore[i], live: live}
+	}
+
+	var newIndex, newStore []string
+	for i := 0; i < len(segments); {
+		batch := []segment{segments[i]}
+		count := len(segments[i].live)
+		j := i + 1
+		for j < len(segments) && count+len(segments[j].live) < capacity {
+			batch = append(batch, segments[j])
+			count += len(segments[j].live)
+			j++
+		}
+
+		newIdxName := s.indexName()
+		newStoreName := s.indexName()
+
+		dst, err := backend.Open(newStoreName)
+		if err != nil {
+			return report, err
+		}
+
+		// Segments in a batch are consecutive and ordered oldest-first, so
+		// an id live in more than one of them (re-Put after a capacity
+		// rollover, without the earlier segment's entry ever being
+		// tombstoned) is only actually live in the segment it was written
+		// to most recently. Dedupe across the whole batch before writing,
+		// keeping the last segment's entry over earlier ones, rather than
+		// per-segment - otherwise both copies survive into the merged
+		// index with identical hashes and Find can return either.
+		type located struct {
+			idxEntry
+			seg int
+		}
+		latest := make(map[identifier]located, count)
+		for i, seg := range batch {
+			for _, e := range seg.live {
+				latest[e.id] = located{idxEntry: e, seg: i}
+			}
+		}
+		if dupes := count - len(latest); dupes > 0 {
+			report.RecordsDropped += dupes
+		}
+
+		var offset int64
+		entries := make([]idxEntry, 0, len(latest))
+		for i, seg := range batch {
+			src, err := backend.Open(seg.storeName)
+			if err != nil {
+				return report, err
+			}
+			for _, e := range seg.live {
+				if latest[e.id].seg != i {
+					// Superseded by a later segment's entry for the same id.
+					continue
+				}
+				b := make([]byte, e.length)
+				if _, err := src.ReadAt(b, int64(e.offset)); err != nil {
+					return report, err
+				}
+				if _, err := dst.WriteAt(b, offset); err != nil {
+					return report, err
+				}
+				e.offset = uint64(offset)
+				entries = append(entries, e)
+				offset += int64(len(b))
+				report.RecordsKept++
+			}
+		}
+
+		if err := rebuildIdx(backend, newIdxName, entries); err != nil {
+			return report, err
+		}
+
+		newIndex = append(newIndex, newIdxName)
+		newStore = append(newStore, newStoreName)
+		i = j
+	}
+
+	var oldBytes, newBytes int64
+	for _, seg := range segments {
+		if s, err := backend.Open(seg.storeName); err == nil {
+			if n, err := s.Size(); err == nil {
+				oldBytes += n
+			}
+		}
+	}
+	for _, name := range newStore {
+		if s, err := backend.Open(name); err == nil {
+			if n, err := s.Size(); err == nil {
+				newBytes += n
+			}
+		}
+	}
+	report.BytesReclaimed = int(oldBytes - newBytes)
+	report.SegmentsAfter = len(newIndex)
+
+	s.mu.Lock()
+	for _, seg := range segments {
+		s.evictIdxReader(seg.indexName)
+
+		s.idxMu.Lock()
+		delete(s.idxWriters, seg.indexName)
+		s.idxMu.Unlock()
+	}
+	s.index = append(newIndex, s.index[sealed:]...)
+	s.store = append(newStore, s.store[sealed:]...)
+	if s.indexCache != nil {
+		s.indexCache.Clear()
+	}
+	s.mu.Unlock()
+
+	if err := s.Flush(); err != nil {
+		return report, err
+	}
+
+	for _, seg := range segments {
+		backend.Remove(seg.indexName)
+		backend.Remove(seg.storeName)
+	}
+
+	return report, nil
+}
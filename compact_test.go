@@ -0,0 +1,91 @@
+package ghost
+
+import "testing"
+
+// TestCompactReclaimsAndDedupesAcrossSegments exercises the case a plain
+// per-segment dedup misses: an id Put again after a capacity rollover ends
+// up with a live entry in two different sealed segments (Put never removes
+// the old one), and those two segments then get merged into a single batch
+// by Compact. The merge must keep only the most recent entry for that id,
+// not both, and Get must never see the stale copy either before or after.
+func TestCompactReclaimsAndDedupesAcrossSegments(t *testing.T) {
+	s := NewStore("", GobSchema{}, WithBackend(NewMemoryBackend()))
+	s.capacity = 4 // small enough to force a rollover after 4 inserts.
+
+	put := func(id, v string) {
+		if err := s.Put(id, v); err != nil {
+			t.Fatalf("Put(%s): %v", id, err)
+		}
+	}
+	del := func(id string) {
+		if err := s.Delete(id); err != nil {
+			t.Fatalf("Delete(%s): %v", id, err)
+		}
+	}
+
+	// Segment 0 fills up and seals.
+	put("a", "a-v1")
+	put("b", "b-v1")
+	put("p", "p-v1")
+	put("q", "q-v1")
+	// Segment 1: "a" is rewritten here, so its stale segment-0 entry is
+	// still live as far as segment 0's own index is concerned.
+	put("c", "c-v1")
+	put("a", "a-v2")
+	put("r", "r-v1")
+	put("s", "s-v1")
+	// Segment 2 (current, unsealed) - just enough to roll segment 1 over.
+	put("z", "z-v1")
+
+	// Tombstone everything in segments 0 and 1 except "a" and "c", so their
+	// combined live count is small enough for Compact to merge them into
+	// one batch - the case where cross-segment duplicates actually arise.
+	del("b")
+	del("p")
+	del("q")
+	del("r")
+	del("s")
+
+	report, err := s.Compact()
+	if err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if report.SegmentsBefore != 2 {
+		t.Fatalf("SegmentsBefore = %d, want 2 (test setup should seal exactly 2 segments)", report.SegmentsBefore)
+	}
+	if report.SegmentsAfter != 1 {
+		t.Fatalf("SegmentsAfter = %d, want 1 (segments 0 and 1 should merge into one batch)", report.SegmentsAfter)
+	}
+	if report.BytesReclaimed <= 0 {
+		t.Fatalf("BytesReclaimed = %d, want > 0", report.BytesReclaimed)
+	}
+	// Only "a" (latest copy) and "c" should survive the merge: without
+	// cross-segment dedup, both of "a"'s copies would be kept.
+	if report.RecordsKept != 2 {
+		t.Fatalf("RecordsKept = %d, want 2 (stale duplicate for a should have been dropped)", report.RecordsKept)
+	}
+
+	var got string
+	if err := s.Get("a", &got); err != nil {
+		t.Fatalf("Get(a) after compact: %v", err)
+	}
+	if got != "a-v2" {
+		t.Fatalf("Get(a) after compact = %q, want a-v2 (stale duplicate survived compaction)", got)
+	}
+
+	got = ""
+	if err := s.Get("c", &got); err != nil {
+		t.Fatalf("Get(c) after compact: %v", err)
+	}
+	if got != "c-v1" {
+		t.Fatalf("Get(c) after compact = %q, want c-v1", got)
+	}
+
+	got = "untouched"
+	if err := s.Get("b", &got); err != nil {
+		t.Fatalf("Get(b) after compact: %v", err)
+	}
+	if got != "untouched" {
+		t.Fatalf("Get(b) after compact populated %q, want deleted id to leave o untouched", got)
+	}
+}
@@ -0,0 +1,484 @@
+package ghost
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"hash/crc32"
+	"sort"
+
+	"github.com/go-errors/errors"
+)
+
+// Binary index file format, modeled on the pack-index scheme used by git
+// packfiles: a fanout table keyed on the first byte of a hashed identifier
+// points into a sorted array of fixed-size records, which lets GetMeta
+// binary-search a single index with one seek+read instead of decoding the
+// entire file into a map.
+//
+// New entries can't be spliced into that sorted array without rewriting it,
+// so Put instead appends self-delimiting, variable-length records to an
+// "overflow" section at the true end of the file; a linear scan over the
+// (small, bounded by how long it's been since the last Compact) overflow
+// section covers those until Compact folds them back into a fresh sorted
+// array.
+//
+// Layout:
+//
+//	[0:4]    magic "GIDX"
+//	[4:8]    version
+//	[8:12]   mainCount    (records in the sorted array)
+//	[12:16]  overflowCount
+//	[16:20]  blobSize     (size in bytes of the id blob following the sorted array)
+//	[20:24]  checksum     (CRC32 of the sorted array + blob, as of the last rebuild)
+//	[24:1048] fanout table, 256 x uint32, fanout[b] = count of records with hash[0] <= b
+//	[1048:)  sorted array (mainCount * idxEntrySize bytes), id blob (blobSize bytes),
+//	         then overflow records appended in write order.
+//
+// The checksum lives in the fixed header, rather than as a trailing footer
+// after the blob, so that the overflow section always begins exactly at
+// idxHeader.overflowStart() - appends never have to account for a footer
+// sitting between the blob and the overflow section.
+const (
+	idxMagic     = "GIDX"
+	idxVersion   = uint32(1)
+	idxHashLen   = sha1.Size
+	idxEntrySize = idxHashLen + 4 + 2 + 8 + 4 + 4 + 1 // hash + idOffset + idLen + offset + len + crc32 + flags
+
+	idxHeaderSize = 4 + 4 + 4 + 4 + 4 + 4 + 256*4
+
+	idxMainCountOffset     = 8
+	idxOverflowCountOffset = 12
+	idxBlobSizeOffset      = 16
+	idxChecksumOffset      = 20
+	idxFanoutOffset        = 24
+)
+
+func idxHash(id identifier) [idxHashLen]byte {
+	return sha1.Sum([]byte(id))
+}
+
+// idxEntry is a single record in a binary index file.
+type idxEntry struct {
+	hash    [idxHashLen]byte
+	id      identifier
+	offset  uint64
+	length  uint32
+	crc32   uint32
+	deleted bool
+}
+
+func newIdxEntry(id identifier, m meta) idxEntry {
+	return idxEntry{
+		hash:    idxHash(id),
+		id:      id,
+		offset:  uint64(m.Offset),
+		length:  uint32(m.Len),
+		crc32:   m.Crc32,
+		deleted: m.Deleted,
+	}
+}
+
+func (e idxEntry) meta(idx int) meta {
+	return meta{Index: idx, Offset: int(e.offset), Len: int(e.length), Crc32: e.crc32, Deleted: e.deleted}
+}
+
+func idxFlags(deleted bool) byte {
+	if deleted {
+		return 1
+	}
+	return 0
+}
+
+type idxHeader struct {
+	mainCount     uint32
+	overflowCount uint32
+	blobSize      uint32
+	checksum      uint32
+	fanout        [256]uint32
+}
+
+func (h idxHeader) bytes() []byte {
+	b := make([]byte, idxHeaderSize)
+	copy(b[0:4], idxMagic)
+	binary.BigEndian.PutUint32(b[4:8], idxVersion)
+	binary.BigEndian.PutUint32(b[8:12], h.mainCount)
+	binary.BigEndian.PutUint32(b[12:16], h.overflowCount)
+	binary.BigEndian.PutUint32(b[16:20], h.blobSize)
+	binary.BigEndian.PutUint32(b[20:24], h.checksum)
+	for i, v := range h.fanout {
+		binary.BigEndian.PutUint32(b[idxFanoutOffset+i*4:idxFanoutOffset+i*4+4], v)
+	}
+	return b
+}
+
+func readIdxHeader(b []byte) idxHeader {
+	var h idxHeader
+	h.mainCount = binary.BigEndian.Uint32(b[8:12])
+	h.overflowCount = binary.BigEndian.Uint32(b[12:16])
+	h.blobSize = binary.BigEndian.Uint32(b[16:20])
+	h.checksum = binary.BigEndian.Uint32(b[20:24])
+	for i := 0; i < 256; i++ {
+		h.fanout[i] = binary.BigEndian.Uint32(b[idxFanoutOffset+i*4 : idxFanoutOffset+i*4+4])
+	}
+	return h
+}
+
+// overflowStart is the offset of the first overflow record: right after the
+// sorted array and its id blob.
+func (h idxHeader) overflowStart() int64 {
+	return int64(idxHeaderSize) + int64(h.mainCount)*int64(idxEntrySize) + int64(h.blobSize)
+}
+
+// idxWriter streams entries into a binary index file. Add appends a single
+// overflow record in O(1) (one WriteAt at the true end of the segment, plus
+// an in-place header update) rather than re-serializing the whole index, as
+// writeIndex used to.
+//
+// It operates on a Segment rather than an *os.File directly, so an index
+// file is just one more named byte range as far as a Backend is concerned;
+// the sorted-array-plus-overflow layout above is unaware of whether that
+// range is a file on disk, a BoltDB value, or an in-memory buffer.
+type idxWriter struct {
+	seg Segment
+}
+
+func openIdxWriter(backend Backend, name string) (*idxWriter, error) {
+	seg, err := backend.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := seg.Size()
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		if _, err := seg.WriteAt(idxHeader{}.bytes(), 0); err != nil {
+			return nil, err
+		}
+	}
+
+	return &idxWriter{seg: seg}, nil
+}
+
+// Add appends a single record to the overflow section of the index file and
+// bumps the overflow count in the header. It never touches the sorted main
+// section, so writes stay append-only until the next Compact.
+func (w *idxWriter) Add(id identifier, m meta) error {
+	headerBytes := make([]byte, idxHeaderSize)
+	if _, err := w.seg.ReadAt(headerBytes, 0); err != nil {
+		return err
+	}
+	h := readIdxHeader(headerBytes)
+
+	size, err := w.seg.Size()
+	if err != nil {
+		return err
+	}
+
+	e := newIdxEntry(id, m)
+	b := make([]byte, idxHashLen+8+4+4+1+2+len(id))
+	copy(b[0:idxHashLen], e.hash[:])
+	binary.BigEndian.PutUint64(b[idxHashLen:idxHashLen+8], e.offset)
+	binary.BigEndian.PutUint32(b[idxHashLen+8:idxHashLen+12], e.length)
+	binary.BigEndian.PutUint32(b[idxHashLen+12:idxHashLen+16], e.crc32)
+	b[idxHashLen+16] = idxFlags(e.deleted)
+	binary.BigEndian.PutUint16(b[idxHashLen+17:idxHashLen+19], uint16(len(id)))
+	copy(b[idxHashLen+19:], id)
+
+	if _, err := w.seg.WriteAt(b, size); err != nil {
+		return err
+	}
+
+	overflowBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(overflowBytes, h.overflowCount+1)
+	if _, err := w.seg.WriteAt(overflowBytes, idxOverflowCountOffset); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Close is a no-op: the underlying Segment is owned and cached by the
+// Backend it came from, and may still be in use by this index's idxReader,
+// so only the Backend itself closes the real handle.
+func (w *idxWriter) Close() error {
+	return nil
+}
+
+// rebuildIdxBytes folds a full set of live entries into the on-disk bytes of
+// a fresh sorted index file with an empty overflow section, sorting entries
+// by hash as a side effect. It's the pure part of rebuilding an index file;
+// rebuildIdx and MigrateIndex each handle writing the result out through
+// whatever medium they use.
+func rebuildIdxBytes(entries []idxEntry) []byte {
+	sort.Slice(entries, func(i, j int) bool {
+		return lessHash(entries[i].hash, entries[j].hash)
+	})
+
+	idBlob := make([]byte, 0, len(entries)*16)
+	idOffsets := make([]int64, len(entries))
+	idBlobOffset := int64(idxHeaderSize) + int64(len(entries))*int64(idxEntrySize)
+	for i, e := range entries {
+		idOffsets[i] = idBlobOffset + int64(len(idBlob))
+		idBlob = append(idBlob, []byte(e.id)...)
+	}
+
+	var h idxHeader
+	h.mainCount = uint32(len(entries))
+	h.blobSize = uint32(len(idBlob))
+	for _, e := range entries {
+		h.fanout[e.hash[0]]++
+	}
+	for i := 1; i < 256; i++ {
+		h.fanout[i] += h.fanout[i-1]
+	}
+
+	entryBytes := make([]byte, 0, len(entries)*idxEntrySize)
+	for i, e := range entries {
+		b := make([]byte, idxEntrySize)
+		copy(b[0:idxHashLen], e.hash[:])
+		binary.BigEndian.PutUint32(b[idxHashLen:idxHashLen+4], uint32(idOffsets[i]))
+		binary.BigEndian.PutUint16(b[idxHashLen+4:idxHashLen+6], uint16(len(e.id)))
+		binary.BigEndian.PutUint64(b[idxHashLen+6:idxHashLen+14], e.offset)
+		binary.BigEndian.PutUint32(b[idxHashLen+14:idxHashLen+18], e.length)
+		binary.BigEndian.PutUint32(b[idxHashLen+18:idxHashLen+22], e.crc32)
+		b[idxHashLen+22] = idxFlags(e.deleted)
+		entryBytes = append(entryBytes, b...)
+	}
+
+	checksum := crc32.NewIEEE()
+	checksum.Write(entryBytes)
+	checksum.Write(idBlob)
+	h.checksum = checksum.Sum32()
+
+	out := make([]byte, 0, idxHeaderSize+len(entryBytes)+len(idBlob))
+	out = append(out, h.bytes()...)
+	out = append(out, entryBytes...)
+	out = append(out, idBlob...)
+	return out
+}
+
+// rebuildIdx folds a full set of live entries into a fresh sorted index
+// segment named name, with an empty overflow section. This is what Compact
+// uses to collapse a file's overflow records back into the
+// binary-searchable main array.
+func rebuildIdx(backend Backend, name string, entries []idxEntry) error {
+	seg, err := backend.Open(name)
+	if err != nil {
+		return err
+	}
+	if err := seg.Truncate(0); err != nil {
+		return err
+	}
+	_, err = seg.WriteAt(rebuildIdxBytes(entries), 0)
+	return err
+}
+
+func lessHash(a, b [idxHashLen]byte) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// idxReader provides O(log n) lookups against a binary index file's sorted
+// main array using its in-memory fanout table, falling back to a linear
+// scan of the (small, bounded by time-since-last-Compact) overflow section.
+// It holds the whole segment as a byte slice (an mmap behind the
+// filesystem Backend; a plain in-memory copy behind anything that can't
+// hand back a zero-copy view) rather than issuing a ReadAt per record, so a
+// lookup costs a handful of memory reads instead of syscalls.
+//
+// The Store always reopens an idxReader (via evictIdxReader) after a write
+// to the same index, so b is a stable snapshot for the lifetime of this
+// reader - it never needs to notice the segment growing underneath it.
+type idxReader struct {
+	seg Segment
+	b   []byte
+	h   idxHeader
+}
+
+func openIdxReader(backend Backend, name string) (*idxReader, error) {
+	seg, err := backend.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	b, ok := seg.Bytes()
+	if !ok {
+		size, err := seg.Size()
+		if err != nil {
+			return nil, err
+		}
+		b = make([]byte, size)
+		if size > 0 {
+			if _, err := seg.ReadAt(b, 0); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	r := &idxReader{seg: seg, b: b}
+	if len(b) >= idxHeaderSize {
+		r.h = readIdxHeader(b)
+	}
+
+	return r, nil
+}
+
+// Close is a no-op: the Segment behind an idxReader is owned and cached by
+// the Backend it came from, and may still be in use by this index's
+// idxWriter, so only the Backend itself closes the real handle.
+func (r *idxReader) Close() error {
+	return nil
+}
+
+// Verify recomputes the CRC32 of the sorted array and id blob and compares
+// it against the checksum recorded in the header at the last rebuild,
+// catching corruption of the main section (overflow records aren't covered,
+// since they're written after the checksum was taken).
+func (r *idxReader) Verify() error {
+	n := int64(r.h.mainCount)*int64(idxEntrySize) + int64(r.h.blobSize)
+	b := make([]byte, n)
+	if n > 0 {
+		copy(b, r.b[idxHeaderSize:int64(idxHeaderSize)+n])
+	}
+	if crc32.ChecksumIEEE(b) != r.h.checksum {
+		return errors.Errorf("ghost: index checksum mismatch")
+	}
+	return nil
+}
+
+// readMainEntryAt reads the nth record of the sorted main array.
+func (r *idxReader) readMainEntryAt(n uint32) (idxEntry, error) {
+	off := int64(idxHeaderSize) + int64(n)*int64(idxEntrySize)
+	b := r.b[off : off+idxEntrySize]
+
+	var e idxEntry
+	copy(e.hash[:], b[0:idxHashLen])
+	idOffset := int64(binary.BigEndian.Uint32(b[idxHashLen : idxHashLen+4]))
+	idLen := int64(binary.BigEndian.Uint16(b[idxHashLen+4 : idxHashLen+6]))
+	e.offset = binary.BigEndian.Uint64(b[idxHashLen+6 : idxHashLen+14])
+	e.length = binary.BigEndian.Uint32(b[idxHashLen+14 : idxHashLen+18])
+	e.crc32 = binary.BigEndian.Uint32(b[idxHashLen+18 : idxHashLen+22])
+	e.deleted = b[idxHashLen+22] != 0
+	e.id = identifier(r.b[idOffset : idOffset+idLen])
+
+	return e, nil
+}
+
+// readOverflowEntries parses every record in the overflow section, in the
+// order they were appended. Each record is self-delimiting, so the section
+// has to be read sequentially from its start rather than by index.
+func (r *idxReader) readOverflowEntries() ([]idxEntry, error) {
+	out := make([]idxEntry, 0, r.h.overflowCount)
+	off := r.h.overflowStart()
+	b := r.b
+
+	for i := uint32(0); i < r.h.overflowCount; i++ {
+		prefix := b[off : off+idxHashLen+8+4+4+1+2]
+
+		var e idxEntry
+		copy(e.hash[:], prefix[0:idxHashLen])
+		e.offset = binary.BigEndian.Uint64(prefix[idxHashLen : idxHashLen+8])
+		e.length = binary.BigEndian.Uint32(prefix[idxHashLen+8 : idxHashLen+12])
+		e.crc32 = binary.BigEndian.Uint32(prefix[idxHashLen+12 : idxHashLen+16])
+		e.deleted = prefix[idxHashLen+16] != 0
+		idLen := binary.BigEndian.Uint16(prefix[idxHashLen+17 : idxHashLen+19])
+
+		e.id = identifier(b[off+int64(len(prefix)) : off+int64(len(prefix))+int64(idLen)])
+
+		out = append(out, e)
+		off += int64(len(prefix)) + int64(idLen)
+	}
+
+	return out, nil
+}
+
+// Find scans the overflow section first (most recent writes last, so it's
+// walked backwards) and only falls back to a fanout-guided binary search of
+// the sorted main section if id isn't there. Every overflow record was
+// appended after the main section was last rebuilt, so it always takes
+// precedence over whatever the main section says about the same id - this
+// is what lets Delete's tombstones and repeated Puts override an older
+// entry without rewriting the sorted array.
+func (r *idxReader) Find(id identifier) (*meta, error) {
+	overflow, err := r.readOverflowEntries()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(overflow) - 1; i >= 0; i-- {
+		if overflow[i].id == id {
+			m := overflow[i].meta(0)
+			return &m, nil
+		}
+	}
+
+	hash := idxHash(id)
+
+	lo := uint32(0)
+	if hash[0] > 0 {
+		lo = r.h.fanout[hash[0]-1]
+	}
+	hi := r.h.fanout[hash[0]]
+
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		e, err := r.readMainEntryAt(mid)
+		if err != nil {
+			return nil, err
+		}
+		if lessHash(hash, e.hash) {
+			hi = mid
+		} else if lessHash(e.hash, hash) {
+			lo = mid + 1
+		} else if e.id == id {
+			m := e.meta(0)
+			return &m, nil
+		} else {
+			// Distinct ids that hash identically: treat as not found in the
+			// main section, since a true SHA-1 collision between live ids
+			// is vanishingly unlikely.
+			break
+		}
+	}
+
+	return nil, nil
+}
+
+// FindCRC32 returns the stored CRC32 of the object bytes for id, allowing a
+// caller to verify the on-disk payload hasn't been corrupted without fully
+// decoding it. It returns an error if the identifier isn't present.
+func (r *idxReader) FindCRC32(id identifier) (uint32, error) {
+	m, err := r.Find(id)
+	if err != nil {
+		return 0, err
+	}
+	if m == nil {
+		return 0, errors.Errorf("ghost: no such identifier %q", id)
+	}
+	return m.Crc32, nil
+}
+
+// entries reads back every entry in the index file (main section followed
+// by overflow, in on-disk order). Used by Compact and readIndex, both of
+// which need the full set.
+func (r *idxReader) entries() ([]idxEntry, error) {
+	out := make([]idxEntry, 0, r.h.mainCount+r.h.overflowCount)
+	for i := uint32(0); i < r.h.mainCount; i++ {
+		e, err := r.readMainEntryAt(i)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+
+	overflow, err := r.readOverflowEntries()
+	if err != nil {
+		return nil, err
+	}
+	return append(out, overflow...), nil
+}
@@ -0,0 +1,83 @@
+package ghost
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestIdxFileRoundTrip writes entries through idxWriter's overflow path,
+// rebuilds them into the sorted main section the way Compact would, and
+// checks that the overflow-only reader answers Find and FindCRC32 correctly
+// for every id, and that the rebuilt reader's Find returns every id's CRC32.
+func TestIdxFileRoundTrip(t *testing.T) {
+	backend := NewMemoryBackend()
+	defer backend.Close()
+
+	w, err := openIdxWriter(backend, "idx0")
+	if err != nil {
+		t.Fatalf("openIdxWriter: %v", err)
+	}
+
+	want := make(map[identifier]meta)
+	for i := 0; i < 50; i++ {
+		id := identifier(fmt.Sprintf("id-%03d", i))
+		m := meta{Offset: i * 10, Len: 10, Crc32: uint32(i)}
+		if err := w.Add(id, m); err != nil {
+			t.Fatalf("Add(%s): %v", id, err)
+		}
+		want[id] = m
+	}
+
+	r, err := openIdxReader(backend, "idx0")
+	if err != nil {
+		t.Fatalf("openIdxReader: %v", err)
+	}
+	for id, m := range want {
+		got, err := r.Find(id)
+		if err != nil {
+			t.Fatalf("Find(%s): %v", id, err)
+		}
+		if got == nil || got.Offset != m.Offset || got.Len != m.Len || got.Crc32 != m.Crc32 {
+			t.Fatalf("Find(%s) = %+v, want %+v", id, got, m)
+		}
+		if crc, err := r.FindCRC32(id); err != nil || crc != m.Crc32 {
+			t.Fatalf("FindCRC32(%s) = %d, %v, want %d, nil", id, crc, err, m.Crc32)
+		}
+	}
+	if _, err := r.FindCRC32("missing"); err == nil {
+		t.Fatal("FindCRC32(missing) should error")
+	}
+	r.Close()
+
+	// Rebuild into the sorted main section, as Compact does, and confirm
+	// the fanout-guided binary search finds the same entries.
+	r2, err := openIdxReader(backend, "idx0")
+	if err != nil {
+		t.Fatalf("openIdxReader: %v", err)
+	}
+	all, err := r2.entries()
+	if err != nil {
+		t.Fatalf("entries: %v", err)
+	}
+	r2.Close()
+
+	if err := rebuildIdx(backend, "idx0", all); err != nil {
+		t.Fatalf("rebuildIdx: %v", err)
+	}
+
+	r3, err := openIdxReader(backend, "idx0")
+	if err != nil {
+		t.Fatalf("openIdxReader after rebuild: %v", err)
+	}
+	defer r3.Close()
+
+	for id, m := range want {
+		got, err := r3.Find(id)
+		if err != nil {
+			t.Fatalf("Find(%s) after rebuild: %v", id, err)
+		}
+		if got == nil || got.Crc32 != m.Crc32 {
+			t.Fatalf("Find(%s) after rebuild = %+v, want %+v", id, got, m)
+		}
+	}
+}
@@ -1,146 +1,212 @@
 package ghost
 
 import (
-	"encoding/json"
-	"io/ioutil"
-	"os"
-	"path"
 	"sync"
 )
 
+// meta describes where an object lives within a store segment.
 type meta struct {
-	Index  int `json:"index"`
-	Len    int `json:"len"`
-	Offset int `json:"offset"`
+	Index   int    `json:"index"`
+	Len     int    `json:"len"`
+	Offset  int    `json:"offset"`
+	Crc32   uint32 `json:"crc32"`
+	Deleted bool   `json:"deleted"`
 }
 
 type identifier string
 
 type index map[identifier]meta
 
-func readIndex(name string) (index, error) {
-	var i index
-	if _, err := os.Stat(name); err == nil {
-		b, err := ioutil.ReadFile(name)
-		if err != nil {
-			return nil, err
-		}
+// readIndex loads the most recent entry for every id in a binary index
+// segment, tombstones included, into an in-memory map. It's only used to rebuild the identifier set on Open; the
+// hot GetMeta path below goes through the cached idxReader instead so it
+// never has to decode a whole index file just to answer one lookup.
+func readIndex(backend Backend, name string) (index, error) {
+	r, err := openIdxReader(backend, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
 
-		err = json.Unmarshal(b, &i)
-		if err != nil {
-			panic(err)
-		}
-	} else {
-		i = make(index)
+	entries, err := r.entries()
+	if err != nil {
+		return nil, err
+	}
+
+	i := make(index, len(entries))
+	for _, e := range entries {
+		i[e.id] = e.meta(0)
 	}
 	return i, nil
 }
 
-func writeIndex(name string, id identifier, m meta) error {
-	var (
-		i index
-		f *os.File
-	)
+// idxReaderFor returns the cached idxReader for an index segment, opening
+// and caching it (which loads its small fanout table into memory) on first
+// use.
+func (s *Store) idxReaderFor(idxName string) (*idxReader, error) {
+	s.idxMu.Lock()
+	defer s.idxMu.Unlock()
 
-	var err error
-	f, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0664)
+	if r, ok := s.idxReaders[idxName]; ok {
+		return r, nil
+	}
+
+	r, err := openIdxReader(s.backend, idxName)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	s.idxReaders[idxName] = r
+	return r, nil
+}
 
-	if info, err := f.Stat(); err == nil && info.Size() == 0 {
-		i = make(index)
-	} else {
-		b, err := ioutil.ReadAll(f)
-		if err != nil {
-			panic(err)
-		}
-		err = json.Unmarshal(b, &i)
-		if err != nil {
-			panic(err)
-		}
+// evictIdxReader closes and drops a cached idxReader, if one is present, so
+// a later idxReaderFor re-opens (and remaps) the file instead of serving
+// stale data from before the eviction.
+func (s *Store) evictIdxReader(idxName string) {
+	s.idxMu.Lock()
+	defer s.idxMu.Unlock()
+
+	if r, ok := s.idxReaders[idxName]; ok {
+		r.Close()
+		delete(s.idxReaders, idxName)
 	}
+}
+
+// idxWriterFor returns the cached idxWriter for an index file, opening and
+// caching it on first use.
+func (s *Store) idxWriterFor(idxName string) (*idxWriter, error) {
+	s.idxMu.Lock()
+	defer s.idxMu.Unlock()
 
-	i[id] = m
-	b, err := json.Marshal(i)
+	if w, ok := s.idxWriters[idxName]; ok {
+		return w, nil
+	}
+
+	w, err := openIdxWriter(s.backend, idxName)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	s.idxWriters[idxName] = w
+	return w, nil
+}
 
-	err = f.Truncate(0)
+// PutMeta commits the metadata of an identifier to the current index. It
+// appends a single entry record (see idxfile.go) rather than re-serializing
+// the whole index, as the old JSON-backed writeIndex did.
+func (s *Store) PutMeta(id identifier, m meta) error {
+	idxName := s.index[len(s.index)-1]
+
+	w, err := s.idxWriterFor(idxName)
 	if err != nil {
 		return err
 	}
-	_, err = f.Seek(0, 0)
-	if err != nil {
+	if err := w.Add(id, m); err != nil {
 		return err
 	}
 
-	_, err = f.Write(b)
-	return err
+	// The reader's cached mapping is now stale for the entry we just
+	// appended; drop it so the next GetMeta reopens and remaps, picking up
+	// the new overflow record. The fanout table itself (the expensive part
+	// to keep warm) is unaffected until the next Compact.
+	s.evictIdxReader(idxName)
+
+	return nil
 }
 
-// Put commits the metadata of an identifier to an index.
-func (s *Store) PutMeta(id identifier, m meta) error {
-	return writeIndex(path.Join(s.dir, s.index[len(s.index)-1]), id, m)
+type metaResult struct {
+	m     meta
+	found bool
+	err   error
 }
 
-// Get retrieves the metadata of an identifier from the index it is stored in.
+// GetMeta retrieves the metadata of an identifier from the index it is
+// stored in. Each index file's fanout table is cached in memory
+// (idxReaderFor), so each goroutine below issues at most one seek+read
+// against its index instead of decoding the entire file.
+//
+// Every goroutine is always waited on before GetMeta returns, even once a
+// hit has been found: the reader it uses is backed by an mmap that a
+// concurrent Delete/Compact can unmap as soon as the store lock is free
+// again, and a goroutine still reading from it at that point wouldn't just
+// see stale data, it would fault.
 func (s *Store) GetMeta(id identifier) (*meta, error) {
+	results := make(chan metaResult, len(s.index))
 
-	c := make(chan meta, 1)
-	r := make(chan bool, len(s.index))
+	var wg sync.WaitGroup
+	wg.Add(len(s.index))
+	for i, indexName := range s.index {
+		go func(idx int, name string) {
+			defer wg.Done()
 
-	var (
-		once    sync.Once
-		errOnce error
-	)
-	for _, indexName := range s.index {
-		go func(idx string, m chan<- meta, results chan<- bool) {
-			idxName := path.Join(s.dir, idx)
-			var i index
-			if f, ok := s.files[idxName]; ok {
-				err := json.NewDecoder(f).Decode(&i)
-				if err != nil {
-					once.Do(func() {
-						results <- false
-						errOnce = err
-					})
-				}
-			} else {
-				var err error
-				i, err = readIndex(idxName)
-				if err != nil {
-					once.Do(func() {
-						results <- false
-						errOnce = err
-					})
-				}
+			reader, err := s.idxReaderFor(name)
+			if err != nil {
+				results <- metaResult{err: err}
+				return
 			}
 
-			if v, ok := i[id]; ok {
-				m <- v
-				results <- true
+			found, err := reader.Find(id)
+			if err != nil {
+				results <- metaResult{err: err}
 				return
 			}
-			results <- false
-			return
-		}(indexName, c, r)
+
+			if found != nil && !found.Deleted {
+				// Find has no notion of which index file it was reading, so
+				// it always reports Index 0; fill in the real segment
+				// position here.
+				found.Index = idx
+				results <- metaResult{m: *found, found: true}
+				return
+			}
+			results <- metaResult{}
+		}(i, indexName)
 	}
 
-	// Wait for all the goroutines to finish.
-	for i := 0; i < len(s.index); i++ {
-		found := <-r
-		if found {
-			m := <-c
-			return &m, nil
+	wg.Wait()
+	close(results)
+
+	var (
+		found *meta
+		err   error
+	)
+	for res := range results {
+		if res.err != nil && err == nil {
+			err = res.err
+			continue
+		}
+		// A live id can have an entry in more than one segment - it was
+		// re-Put after a capacity rollover, and the earlier segment's
+		// entry hasn't been dropped yet by a Compact. The higher segment
+		// index is always the most recently written one, so it wins, the
+		// same tie-break Compact's own cross-segment dedup uses.
+		if res.found && (found == nil || res.m.Index > found.Index) {
+			m := res.m
+			found = &m
 		}
 	}
-
-	// If there was an error, quit.
-	if errOnce != nil {
-		return nil, errOnce
+	if found != nil {
+		return found, nil
 	}
 
-	return nil, nil
+	return nil, err
+}
+
+// closeIdx closes every cached idxReader/idxWriter. Called from Store.Close.
+func (s *Store) closeIdx() error {
+	s.idxMu.Lock()
+	defer s.idxMu.Unlock()
+
+	for name, r := range s.idxReaders {
+		if err := r.Close(); err != nil {
+			return err
+		}
+		delete(s.idxReaders, name)
+	}
+	for name, w := range s.idxWriters {
+		if err := w.Close(); err != nil {
+			return err
+		}
+		delete(s.idxWriters, name)
+	}
+	return nil
 }
@@ -0,0 +1,30 @@
+package ghost
+
+import "testing"
+
+// TestGetMetaPrefersMostRecentSegment covers the window between a re-Put
+// that rolls over to a new segment and the next Compact: the id is live in
+// both the old and the new segment, and GetMeta's fan-out across index
+// files must consistently prefer the most recently written one rather than
+// whichever segment's goroutine answers first.
+func TestGetMetaPrefersMostRecentSegment(t *testing.T) {
+	s := NewStore("", GobSchema{}, WithBackend(NewMemoryBackend()))
+	s.capacity = 1 // force a rollover on every Put after the first.
+
+	if err := s.Put("a", "a-v1"); err != nil {
+		t.Fatalf("Put(a, a-v1): %v", err)
+	}
+	if err := s.Put("a", "a-v2"); err != nil {
+		t.Fatalf("Put(a, a-v2): %v", err)
+	}
+
+	for i := 0; i < 200; i++ {
+		var got string
+		if err := s.Get("a", &got); err != nil {
+			t.Fatalf("Get(a): %v", err)
+		}
+		if got != "a-v2" {
+			t.Fatalf("Get(a) = %q on iteration %d, want a-v2 (stale segment won the fan-out race)", got, i)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package ghost
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// MigrateIndex converts a single legacy JSON-encoded index file in place
+// into the binary format described in idxfile.go. It is a no-op (returning
+// false, nil) if the file is already in the binary format, so it's safe to
+// run repeatedly over a store directory such as by the ghost-reindex tool.
+func MigrateIndex(name string) (migrated bool, err error) {
+	magic := make([]byte, len(idxMagic))
+	if f, err := os.Open(name); err == nil {
+		_, readErr := f.Read(magic)
+		f.Close()
+		if readErr == nil && string(magic) == idxMagic {
+			return false, nil
+		}
+	}
+
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return false, err
+	}
+
+	var i index
+	if err := json.Unmarshal(b, &i); err != nil {
+		return false, err
+	}
+
+	entries := make([]idxEntry, 0, len(i))
+	for id, m := range i {
+		entries = append(entries, newIdxEntry(id, m))
+	}
+
+	tmp := name + ".reindex"
+	if err := ioutil.WriteFile(tmp, rebuildIdxBytes(entries), 0664); err != nil {
+		return false, err
+	}
+
+	if err := os.Rename(tmp, name); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,82 @@
+package ghost
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSegmentBytes bounds how large a single store segment is allowed to
+// grow before Put rolls over to a new one, mirroring the existing
+// capacity-based (insert count) rollover. Segments are mapped in full, so
+// this is what actually keeps any one mmap bounded rather than a cap
+// enforced in remap itself.
+const maxSegmentBytes = 512 * 1024 * 1024
+
+// mmapFile is a read-only memory mapping of a single file, remapped whenever
+// the underlying file grows past what's currently mapped.
+type mmapFile struct {
+	f   *os.File
+	b   []byte
+	cap int64
+}
+
+func openMmapFile(name string) (*mmapFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mmapFile{f: f}
+	if err := m.remap(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// remap re-maps the file to its full current size if it has grown since the
+// last mapping, picking up bytes written by a concurrent writer. It's a
+// no-op if the file is unchanged or empty.
+func (m *mmapFile) remap() error {
+	info, err := m.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := info.Size()
+	if size <= m.cap || size == 0 {
+		return nil
+	}
+
+	if m.b != nil {
+		if err := unix.Munmap(m.b); err != nil {
+			return err
+		}
+		m.b = nil
+	}
+
+	b, err := unix.Mmap(int(m.f.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	m.b = b
+	m.cap = size
+	return nil
+}
+
+// bytes returns the currently mapped region. Callers must not retain slices
+// into it past a Close or remap.
+func (m *mmapFile) bytes() []byte {
+	return m.b
+}
+
+func (m *mmapFile) Close() error {
+	if m.b != nil {
+		if err := unix.Munmap(m.b); err != nil {
+			return err
+		}
+		m.b = nil
+	}
+	return m.f.Close()
+}
@@ -1,17 +1,18 @@
 package ghost
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/go-errors/errors"
-	"io/ioutil"
+	"hash/crc32"
 	"math/rand"
-	"os"
-	"path"
 	"sync"
 	"time"
 )
 
+const confSegment = "conf"
+
 type info struct {
 	Inserts  int      `json:"inserts"`
 	Capacity int      `json:"capacity"`
@@ -20,18 +21,6 @@ type info struct {
 	Stores   []string `json:"stores"`
 }
 
-type workingIndex struct {
-	idx int
-	set bool
-	index
-}
-
-type workingStore struct {
-	idx  int
-	set  bool
-	data []byte
-}
-
 // Store
 type Store struct {
 	inserts  int      // What is the size of the current Index?
@@ -42,11 +31,14 @@ type Store struct {
 	store    []string // Which store is the document contained in? (object store).
 
 	indexCache *IndexCache
-	files      map[string]*os.File
+	backend    Backend
+	chunks     *chunkReader
+
+	idxReaders map[string]*idxReader
+	idxWriters map[string]*idxWriter
+	idxMu      sync.Mutex
 
-	workingIndex workingIndex
-	workingStore workingStore
-	identifiers  map[identifier]bool
+	identifiers map[identifier]bool
 
 	dir string
 	mu  sync.Mutex
@@ -58,13 +50,34 @@ func (s *Store) indexName() string {
 
 type StoreOption func(s *Store)
 
-// WithIndexCache will cache identifiers randomly with the specified capacity.
+// WithIndexCache caches up to capacity identifiers' meta as an LRU, evicting
+// the least-recently-used entry once full.
 func WithIndexCache(capacity int) StoreOption {
 	return func(s *Store) {
 		s.indexCache = NewIndexCache(capacity)
 	}
 }
 
+// WithIndexCacheBytes is WithIndexCache bounded by an estimate of the
+// meta/identifier bytes held rather than by entry count - useful when
+// identifiers vary widely in length and a flat entry cap either wastes
+// memory or evicts too eagerly.
+func WithIndexCacheBytes(capacity, maxBytes int) StoreOption {
+	return func(s *Store) {
+		s.indexCache = NewIndexCache(capacity, WithMaxBytes(maxBytes))
+	}
+}
+
+// WithBackend overrides the default filesystem Backend (a directory of
+// files at dir) with b. This is what lets a Store run somewhere that can't
+// open raw filesystem paths - under WASM, say, or on top of an object
+// store - by handing it an in-memory or BoltDB-backed Backend instead.
+func WithBackend(b Backend) StoreOption {
+	return func(s *Store) {
+		s.backend = b
+	}
+}
+
 // NewStore creates a new object store.
 func NewStore(dir string, schema Schema, options ...StoreOption) *Store {
 	rand.Seed(time.Now().UnixNano())
@@ -73,43 +86,52 @@ func NewStore(dir string, schema Schema, options ...StoreOption) *Store {
 		capacity:    1e5,
 		schema:      schema,
 		dir:         dir,
-		files:       make(map[string]*os.File),
+		idxReaders:  make(map[string]*idxReader),
+		idxWriters:  make(map[string]*idxWriter),
 		identifiers: make(map[identifier]bool),
 	}
 
-	s.index = []string{s.indexName()}
-	s.store = []string{s.indexName()}
-
 	for _, option := range options {
 		option(s)
 	}
 
+	if s.backend == nil {
+		// Unlike Open, NewStore never creates dir itself - it assumes the
+		// caller already has (or will) - so it can't fail and doesn't need
+		// an error return.
+		s.backend = newFilesystemBackend(dir)
+	}
+	s.chunks = newChunkReader(s.backend)
+
+	s.index = []string{s.indexName()}
+	s.store = []string{s.indexName()}
+
 	return s
 }
 
-// Close flushes the store and closes all open file pointers.
+// Close flushes the store and closes every resource its Backend is holding
+// open.
 func (s *Store) Close() error {
 	err := s.Flush()
 	if err != nil {
 		return err
 	}
-	for _, f := range s.files {
-		err := f.Close()
-		if err != nil {
-			return err
-		}
+	if err := s.closeIdx(); err != nil {
+		return err
 	}
-	return nil
+	return s.chunks.Close()
 }
 
 func (s *Store) loadIdentifiers() error {
 	for _, i := range s.index {
-		idx, err := readIndex(path.Join(s.dir, i))
+		idx, err := readIndex(s.backend, i)
 		if err != nil {
 			return err
 		}
-		for id := range idx {
-			s.identifiers[id] = true
+		for id, m := range idx {
+			if !m.Deleted {
+				s.identifiers[id] = true
+			}
 		}
 	}
 
@@ -118,72 +140,160 @@ func (s *Store) loadIdentifiers() error {
 
 // Open loads an object store if one exists, or creates one if one is not found.
 func Open(dir string, schema Schema, options ...StoreOption) (*Store, error) {
-	err := os.MkdirAll(dir, 0774)
+	s := &Store{
+		capacity:    1e5,
+		schema:      schema,
+		dir:         dir,
+		idxReaders:  make(map[string]*idxReader),
+		idxWriters:  make(map[string]*idxWriter),
+		identifiers: make(map[identifier]bool),
+	}
+
+	for _, option := range options {
+		option(s)
+	}
+
+	if s.backend == nil {
+		b, err := NewFilesystemBackend(dir)
+		if err != nil {
+			return nil, err
+		}
+		s.backend = b
+	}
+	s.chunks = newChunkReader(s.backend)
+
+	conf, err := s.backend.Open(confSegment)
 	if err != nil {
 		return nil, err
 	}
 
-	confPath := path.Join(dir, "conf")
-	if _, err := os.Stat(confPath); os.IsNotExist(err) {
-		return NewStore(dir, schema), nil
+	size, err := conf.Size()
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		s.index = []string{s.indexName()}
+		s.store = []string{s.indexName()}
+		return s, nil
 	}
 
-	f, err := os.OpenFile(confPath, os.O_RDONLY, 0664)
-	if err != nil {
+	var i info
+	if err := readConf(conf, &i); err != nil {
 		return nil, err
 	}
 
-	var info info
+	s.store = i.Stores
+	s.inserts = i.Inserts
+	s.capacity = i.Capacity
+	s.index = i.Index
+	s.size = i.Size
 
-	err = json.NewDecoder(f).Decode(&info)
-	if err != nil {
+	if err := s.loadIdentifiers(); err != nil {
 		return nil, err
 	}
 
-	s := &Store{
-		store:       info.Stores,
-		inserts:     info.Inserts,
-		capacity:    info.Capacity,
-		index:       info.Index,
-		size:        info.Size,
-		schema:      schema,
-		dir:         dir,
-		files:       make(map[string]*os.File),
-		identifiers: make(map[identifier]bool),
+	return s, nil
+}
+
+// readConf decodes the JSON-encoded info written by Flush out of the conf
+// segment, preferring a zero-copy view when the Segment offers one.
+func readConf(conf Segment, i *info) error {
+	b, ok := conf.Bytes()
+	if !ok {
+		size, err := conf.Size()
+		if err != nil {
+			return err
+		}
+		b = make([]byte, size)
+		if _, err := conf.ReadAt(b, 0); err != nil {
+			return err
+		}
 	}
+	return json.Unmarshal(b, i)
+}
 
-	for _, option := range options {
-		option(s)
+// Reload closes every cached index/store reader and re-reads the store's
+// layout and identifiers from conf, picking up changes made by something
+// other than this Store instance - most notably another process running
+// Compact against the same directory. Recreating the Backend itself is
+// only meaningful (and only done) when it's the default filesystem one:
+// that's the only Backend a second process could be mutating behind this
+// one's back, and it's the one whose cached file handles and mmaps would
+// otherwise go stale.
+func (s *Store) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.closeIdx(); err != nil {
+		return err
 	}
 
-	s.files[confPath] = f
+	if _, ok := s.backend.(*filesystemBackend); ok {
+		if err := s.chunks.Close(); err != nil {
+			return err
+		}
+		b, err := NewFilesystemBackend(s.dir)
+		if err != nil {
+			return err
+		}
+		s.backend = b
+	}
+	s.chunks = newChunkReader(s.backend)
 
-	err = s.loadIdentifiers()
+	conf, err := s.backend.Open(confSegment)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return s, nil
+	var i info
+	if err := readConf(conf, &i); err != nil {
+		return err
+	}
+
+	s.store = i.Stores
+	s.index = i.Index
+	s.capacity = i.Capacity
+	s.inserts = i.Inserts
+	s.size = i.Size
+
+	s.identifiers = make(map[identifier]bool)
+	if err := s.loadIdentifiers(); err != nil {
+		return err
+	}
+
+	if s.indexCache != nil {
+		s.indexCache.Clear()
+	}
+
+	return nil
 }
 
 // Flush commits changes to the store to disk (importantly the most recently updated size and inserts values).
 // This is called automatically after every put.
 func (s *Store) Flush() error {
-	f, err := os.OpenFile(path.Join(s.dir, "conf"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+	conf, err := s.backend.Open(confSegment)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	var info info
+	i := info{
+		Stores:   s.store,
+		Index:    s.index,
+		Capacity: s.capacity,
+		Inserts:  s.inserts,
+		Size:     s.size,
+	}
 
-	info.Stores = s.store
-	info.Index = s.index
-	info.Capacity = s.capacity
-	info.Inserts = s.inserts
-	info.Size = s.size
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(i); err != nil {
+		return err
+	}
 
-	return json.NewEncoder(f).Encode(info)
+	if err := conf.Truncate(0); err != nil {
+		return err
+	}
+	_, err = conf.WriteAt(buf.Bytes(), 0)
+	return err
 }
 
 // Put writes an object with the specified id. A Put does not override existing objects with the same id, only
@@ -197,8 +307,10 @@ func (s *Store) Put(id string, o interface{}) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Reset the inserts if above the maximum.
-	if s.inserts >= s.capacity {
+	// Reset the inserts if above the maximum, or roll over early if the
+	// segment has grown past maxSegmentBytes so no single mmap ever has to
+	// cover more than that.
+	if s.inserts >= s.capacity || s.size+len(b) > maxSegmentBytes {
 		s.inserts = 0
 		s.size = 0
 		s.index = append(s.index, s.indexName())
@@ -207,23 +319,18 @@ func (s *Store) Put(id string, o interface{}) error {
 
 	// Get the current index.
 	idx := len(s.index) - 1
-	idxPath := path.Join(s.dir, s.store[idx])
+	storeName := s.store[idx]
 
-	var f *os.File
-	if v, ok := s.files[idxPath]; ok {
-		f = v
-	} else {
-		// Open the Store for appending.
-		var err error
-		f, err = os.OpenFile(idxPath, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0664)
-		if err != nil {
-			return err
-		}
-		s.files[idxPath] = f
+	seg, err := s.backend.Open(storeName)
+	if err != nil {
+		return err
 	}
 
-	// Append the object to the store.
-	n, err := f.WriteAt(b, int64(s.size))
+	// Append the object to the store segment at the offset this Store has
+	// been tracking in s.size, rather than relying on the backend's notion
+	// of "end of file" - which BoltDB and the in-memory backend have no
+	// equivalent of.
+	n, err := seg.WriteAt(b, int64(s.size))
 	if err != nil {
 		return err
 	}
@@ -233,6 +340,7 @@ func (s *Store) Put(id string, o interface{}) error {
 		Index:  idx,
 		Offset: s.size,
 		Len:    n,
+		Crc32:  crc32.ChecksumIEEE(b),
 	}
 	err = s.PutMeta(identifier(id), m)
 	if err != nil {
@@ -270,27 +378,18 @@ func (s *Store) PutAll(ids []string, o []interface{}) error {
 	return nil
 }
 
-// Get retrieves an object with the specified id, if one exists.
+// Get retrieves an object with the specified id, if one exists. The object's
+// bytes are read via a zero-copy slice into the store segment when the
+// Backend offers one (the filesystem backend's mmap, the in-memory buffer),
+// and via a ReadAt copy otherwise (BoltDB).
 func (s *Store) Get(id string, o interface{}) error {
-
-	var (
-		m *meta
-	)
-
-	if s.workingStore.idx == s.workingIndex.idx && s.workingStore.set && s.workingIndex.set {
-		if m, ok := s.workingIndex.index[identifier(id)]; ok {
-			if m.Offset+m.Len <= len(s.workingStore.data) {
-				return s.schema.Unmarshal(s.workingStore.data[m.Offset:m.Offset+m.Len], o)
-			}
-		}
-	}
-
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	var m *meta
 	if s.indexCache != nil {
-		if v, ok := s.indexCache.lookup[identifier(id)]; ok {
-			m = &s.indexCache.metadata[v]
+		if v, ok := s.indexCache.Get(identifier(id)); ok && !v.Deleted {
+			m = &v
 		}
 	}
 
@@ -307,73 +406,18 @@ func (s *Store) Get(id string, o interface{}) error {
 		return nil
 	}
 
-	storePath := path.Join(s.dir, s.store[m.Index])
-	var f *os.File
-	if v, ok := s.files[storePath]; ok {
-		f = v
-	} else {
-		// Open the Store for appending.
-		var err error
-		f, err = os.OpenFile(storePath, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0664)
-		if err != nil {
-			return err
-		}
-		s.files[storePath] = f
-	}
-
-	// Read the object from disk.
-	b := make([]byte, m.Len)
-	_, err := f.ReadAt(b, int64(m.Offset))
+	b, err := s.chunks.Read(s.store[m.Index], m.Offset, m.Len)
 	if err != nil {
 		return err
 	}
 
-	i, err := readIndex(path.Join(s.dir, s.index[m.Index]))
-	if err != nil {
-		panic(err)
-	}
-	data, err := ioutil.ReadAll(s.files[storePath])
-	if err != nil {
-		panic(err)
-	}
-	s.workingIndex = workingIndex{idx: m.Index, index: i, set: true}
-	s.workingStore = workingStore{idx: m.Index, data: data, set: true}
-
 	return s.schema.Unmarshal(b, o)
 }
 
-//func (s *Store) BulkGet(id []string, o []interface{}) error {
-//	indexes := make([]index, len(s.index))
-//
-//	for i, index := range s.index {
-//		b, err := ioutil.ReadFile(path.Join(s.dir, index))
-//		if err != nil {
-//			return err
-//		}
-//		err = json.Unmarshal(b, indexes[i])
-//		if err != nil {
-//			return err
-//		}
-//	}
-//
-//	for _, index := range indexes {
-//
-//	}
-//}
-
 // Contains checks to see if an object with the specified id is stored in the index.
 func (s *Store) Contains(id string) bool {
-	if _, ok := s.identifiers[identifier(id)]; ok {
-		return true
-	}
-
-	if s.workingStore.idx == s.workingIndex.idx && s.workingStore.set && s.workingIndex.set {
-		if _, ok := s.workingIndex.index[identifier(id)]; ok {
-			return true
-		}
-	}
-
-	return false
+	_, ok := s.identifiers[identifier(id)]
+	return ok
 }
 
 // Size retrieves the size in bytes of the current index.